@@ -2,17 +2,26 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"embed"
 	"encoding/xml"
+	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	texttemplate "text/template"
 	"time"
 
 	"golang.org/x/net/context"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const (
@@ -30,18 +39,58 @@ const (
 	ogImageDefault    = "images/io15-color.png"
 	ogImageExperiment = "images/io15-experiment.png"
 
-	// templatesDir is the templates directory path relative to config.Dir.
+	// templatesDir is the templates directory path relative to config.Dir,
+	// and the root of embeddedTemplates.
 	templatesDir = "templates"
+
+	// defaultContentType is used for templates that don't match
+	// any entry in outputFormats, i.e. regular HTML pages.
+	defaultContentType = "text/html; charset=utf-8"
+
+	// sitemapShardSize is the max number of <url> entries WriteSitemapShard
+	// puts in one shard, kept safely under the sitemaps.org 50,000 limit.
+	sitemapShardSize = 45000
+	// sitemapContentType and sitemapGzipContentType are the Content-Type
+	// values callers should set before writing the index and a shard,
+	// respectively.
+	sitemapContentType     = "application/xml; charset=utf-8"
+	sitemapGzipContentType = "application/gzip"
 )
 
 var (
-	// tmplFunc is a map of functions available to all templates.
+	// tmplFunc is a map of functions available to all HTML templates. url
+	// and T are re-bound per render to the page's Lang by renderTemplate;
+	// the versions here are the "en" fallback used if a template is
+	// executed directly, bypassing renderTemplate.
 	tmplFunc = template.FuncMap{
 		"safeHTML": func(v string) template.HTML { return template.HTML(v) },
 		"url":      resourceURL,
+		"reverse":  reverse,
+		"T":        func(key string, args ...interface{}) string { return i18n.T("en", key, args...) },
+	}
+	// textTmplFunc is a map of functions available to plain-text templates,
+	// e.g. JSON, iCal and other non-HTML output formats. safeHTML is
+	// omitted since it's meaningless outside html/template.
+	textTmplFunc = texttemplate.FuncMap{
+		"url":     resourceURL,
+		"reverse": reverse,
+		"T":       func(key string, args ...interface{}) string { return i18n.T("en", key, args...) },
+	}
+	// tmplCache caches templates parsed in parseTemplate(), keyed by
+	// name+layout. It's a sync.Map rather than a mutex-guarded map so
+	// warmed lookups on the hot render path never contend with each
+	// other; only a cache miss (dev mode, or a combination WarmTemplates
+	// didn't enumerate) pays for parsing.
+	tmplCache sync.Map // map[string]anyTemplate
+
+	// outputFormats maps a template name suffix to how it should be parsed
+	// and served. Names without a recognized suffix are treated as HTML.
+	outputFormats = map[string]outputFormat{
+		".json": {contentType: "application/json; charset=utf-8", text: true},
+		".ics":  {contentType: "text/calendar; charset=utf-8", text: true},
+		".xml":  {contentType: "application/xml; charset=utf-8", text: true},
+		".txt":  {contentType: "text/plain; charset=utf-8", text: true},
 	}
-	// tmplCache caches HTML templates parsed in parseTemplate()
-	tmplCache = &templateCache{templates: make(map[string]*template.Template)}
 
 	// don't include these in sitemap
 	skipSitemap = []string{
@@ -54,10 +103,241 @@ var (
 	}
 )
 
-// templateCache is in-memory cache for parsed templates
-type templateCache struct {
-	sync.Mutex
-	templates map[string]*template.Template
+// routes maps a route name to its URL pattern, e.g. "schedule.session" to
+// "/schedule". A pattern segment written as "{name}" is substituted by
+// reverse; it's otherwise identical to the pattern registered with the
+// HTTP mux for that route, so the two never drift apart.
+var routes = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// RegisterRoute associates name with pattern so it can later be turned
+// back into a URL with the reverse template func. It should be called
+// once per route, alongside the corresponding HTTP mux registration.
+func RegisterRoute(name, pattern string) {
+	routes.Lock()
+	defer routes.Unlock()
+	routes.m[name] = pattern
+}
+
+func init() {
+	RegisterRoute("schedule.session", "/schedule")
+}
+
+// reverse looks up the route registered under name and returns its URL,
+// with config.Prefix applied. args are flattened key/value pairs: a key
+// matching a "{key}" placeholder in the route pattern is substituted in
+// place; any other key/value pair is encoded into the query string. For
+// example, given the "schedule.session" route registered above,
+// reverse("schedule.session", "sid", "abc") returns "/io2015/schedule?sid=abc".
+func reverse(name string, args ...interface{}) (template.URL, error) {
+	routes.RLock()
+	pattern, ok := routes.m[name]
+	routes.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("reverse: unregistered route %q", name)
+	}
+	if len(args)%2 != 0 {
+		return "", fmt.Errorf("reverse: %q: odd number of args", name)
+	}
+
+	q := url.Values{}
+	for i := 0; i < len(args); i += 2 {
+		key, ok := args[i].(string)
+		if !ok {
+			return "", fmt.Errorf("reverse: %q: arg %d is %T, want string", name, i, args[i])
+		}
+		val := fmt.Sprintf("%v", args[i+1])
+		if placeholder := "{" + key + "}"; strings.Contains(pattern, placeholder) {
+			pattern = strings.Replace(pattern, placeholder, url.PathEscape(val), 1)
+		} else {
+			q.Set(key, val)
+		}
+	}
+
+	u := resourceURL(strings.TrimPrefix(pattern, "/"))
+	if enc := q.Encode(); enc != "" {
+		u += "?" + enc
+	}
+	return template.URL(u), nil
+}
+
+// TranslationProvider looks up localized messages loaded from
+// templates/i18n/*.yaml, one file per locale named after its code, e.g.
+// templates/i18n/es.yaml holds the "es" messages.
+type TranslationProvider struct {
+	mu       sync.RWMutex
+	messages map[string]map[string]string // locale -> key -> message
+	locales  []string                     // configured locales, sorted, e.g. ["es", "pt-br"]
+}
+
+// i18n is the package-level translation provider, populated by
+// WarmTranslations. It's safe for concurrent use and starts out empty,
+// so T falls back to the requested key until warmed.
+var i18n = &TranslationProvider{messages: map[string]map[string]string{}}
+
+// LoadTranslations reads every templates/i18n/*.yaml file from src and
+// returns a TranslationProvider serving their contents, keyed by locale.
+func LoadTranslations(src TemplateSource) (*TranslationProvider, error) {
+	entries, err := fs.ReadDir(src, "i18n")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &TranslationProvider{messages: map[string]map[string]string{}}, nil
+		}
+		return nil, err
+	}
+	messages := make(map[string]map[string]string)
+	var locales []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".yaml" {
+			continue
+		}
+		locale := strings.TrimSuffix(e.Name(), ".yaml")
+		b, err := fs.ReadFile(src, path.Join("i18n", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]string
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("LoadTranslations: %s: %v", e.Name(), err)
+		}
+		messages[locale] = m
+		if locale != "en" {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+	return &TranslationProvider{messages: messages, locales: locales}, nil
+}
+
+// WarmTranslations loads templates/i18n/*.yaml into the package-level
+// i18n provider. Like WarmTemplates, it's meant to be called once from
+// main before the server starts accepting requests.
+func WarmTranslations(c context.Context) error {
+	src, err := templateSource()
+	if err != nil {
+		return err
+	}
+	tp, err := LoadTranslations(src)
+	if err != nil {
+		return err
+	}
+	i18n.mu.Lock()
+	i18n.messages, i18n.locales = tp.messages, tp.locales
+	i18n.mu.Unlock()
+	return nil
+}
+
+// T returns the message for key in locale, falling back to "en" and
+// finally to key itself if neither has a translation. If args is
+// non-empty, the message is treated as a fmt.Sprintf format string.
+func (tp *TranslationProvider) T(locale, key string, args ...interface{}) string {
+	tp.mu.RLock()
+	msg, ok := tp.messages[locale][key]
+	if !ok {
+		msg, ok = tp.messages["en"][key]
+	}
+	tp.mu.RUnlock()
+	if !ok {
+		msg = key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Locales returns the configured locale codes, sorted, e.g. ["es", "pt-br"].
+// "en" is the implicit default and isn't included.
+func (tp *TranslationProvider) Locales() []string {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	return append([]string(nil), tp.locales...)
+}
+
+// isLocale reports whether s is one of i18n's configured locales or "en",
+// the implicit default.
+func isLocale(s string) bool {
+	if s == "en" {
+		return true
+	}
+	for _, l := range i18n.Locales() {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// localeForRequest determines which locale to render r in: a
+// "/<locale>/..." URL prefix (after config.Prefix) takes precedence over
+// the Accept-Language header; everything else falls back to "en".
+func localeForRequest(r *http.Request) string {
+	p := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, config.Prefix), "/")
+	if i := strings.IndexByte(p, '/'); i > 0 {
+		if isLocale(p[:i]) {
+			return p[:i]
+		}
+	} else if p != "" && isLocale(p) {
+		return p
+	}
+
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag = strings.TrimSpace(strings.SplitN(tag, ";", 2)[0])
+		if isLocale(tag) {
+			return tag
+		}
+		if i := strings.IndexByte(tag, '-'); i > 0 && isLocale(tag[:i]) {
+			return tag[:i]
+		}
+	}
+	return "en"
+}
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// TemplateSource is the file tree templates are parsed from. In prod and
+// stage it's backed by embeddedTemplates, baked into the binary at build
+// time; in dev mode it's backed by the filesystem under config.Dir so
+// template edits show up without a rebuild.
+type TemplateSource = fs.FS
+
+// templateSource returns the TemplateSource to parse and walk templates
+// from, rooted at templatesDir.
+func templateSource() (TemplateSource, error) {
+	if isDev() {
+		return os.DirFS(filepath.Join(config.Dir, templatesDir)), nil
+	}
+	return fs.Sub(embeddedTemplates, templatesDir)
+}
+
+// anyTemplate is implemented by both html/template.Template and
+// text/template.Template, letting parseTemplate hand back either one
+// depending on the requested output format.
+type anyTemplate interface {
+	Execute(wr io.Writer, data interface{}) error
+	ExecuteTemplate(wr io.Writer, name string, data interface{}) error
+}
+
+// outputFormat describes how a named template should be parsed and
+// which Content-Type its rendered output should be served with.
+type outputFormat struct {
+	contentType string
+	// text indicates the template is parsed with text/template instead
+	// of html/template, e.g. for JSON, iCal or other non-HTML formats.
+	text bool
+}
+
+// formatForName returns the outputFormat for a template name, keyed by
+// its suffix, e.g. "schedule.json" matches ".json". Names with no
+// recognized suffix fall back to HTML.
+func formatForName(name string) outputFormat {
+	if f, ok := outputFormats[filepath.Ext(name)]; ok {
+		return f
+	}
+	return outputFormat{contentType: defaultContentType}
 }
 
 // templateData is the templates context
@@ -72,29 +352,56 @@ type templateData struct {
 	OgTitle      string
 	OgImage      string
 	StartDateStr string
+	// ContentType is the MIME type the rendered template is served with,
+	// e.g. "text/html; charset=utf-8" or "application/json; charset=utf-8".
+	// It is normally left empty and filled in by renderTemplate based on
+	// the template name's output format.
+	ContentType string
+	// Lang is the BCP-47 locale the page is rendered in, e.g. "en" or
+	// "es". It drives the T template func and the url func's locale
+	// prefix; it is normally set by the caller from localeForRequest
+	// before rendering, and defaults to "en" otherwise.
+	Lang string
 	// livestream youtube video IDs
 	LiveIDs []string
 }
 
-type sitemap struct {
-	XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
-	Items   []*sitemapItem
+type sitemapItem struct {
+	XMLName    xml.Name   `xml:"url"`
+	Loc        string     `xml:"loc"`
+	Freq       string     `xml:"changefreq,omitempty"`
+	Mod        *time.Time `xml:"lastmod,omitempty"`
+	Alternates []sitemapAlternate
 }
 
-type sitemapItem struct {
-	XMLName xml.Name   `xml:"url"`
-	Loc     string     `xml:"loc"`
-	Freq    string     `xml:"changefreq,omitempty"`
-	Mod     *time.Time `xml:"lastmod,omitempty"`
+// sitemapAlternate is a Google <xhtml:link rel="alternate" hreflang="...">
+// entry, pointing a canonical sitemapItem at its localized variant. The
+// "xhtml:link" tag is a literal local name rather than a namespace +
+// local name pair, since encoding/xml has no way to emit a element under
+// a prefix declared on an ancestor; see writeURLSet's urlset start tag
+// for the matching xmlns:xhtml declaration.
+type sitemapAlternate struct {
+	XMLName  xml.Name `xml:"xhtml:link"`
+	Rel      string   `xml:"rel,attr"`
+	Hreflang string   `xml:"hreflang,attr"`
+	Href     string   `xml:"href,attr"`
+}
+
+type sitemapIndexItem struct {
+	XMLName xml.Name `xml:"sitemap"`
+	Loc     string   `xml:"loc"`
 }
 
 // renderTemplate executes a template found in name.html file
-// using either layout_full.html or layout_partial.html as the root template.
+// using either layout_full.html or layout_partial.html as the root template,
+// or layout_text.txt for non-HTML output formats (see formatForName).
 // env is the app current environment: "dev", "stage" or "prod".
-func renderTemplate(c context.Context, name string, partial bool, data *templateData) ([]byte, error) {
-	tpl, err := parseTemplate(name, partial)
+// It returns the rendered bytes and the MIME type the caller should serve
+// them with.
+func renderTemplate(c context.Context, name string, partial bool, data *templateData) ([]byte, string, error) {
+	tpl, contentType, err := parseTemplate(name, partial)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if data == nil {
 		data = &templateData{}
@@ -102,6 +409,12 @@ func renderTemplate(c context.Context, name string, partial bool, data *template
 	if data.Env == "" {
 		data.Env = config.Env
 	}
+	if data.ContentType == "" {
+		data.ContentType = contentType
+	}
+	if data.Lang == "" {
+		data.Lang = "en"
+	}
 	data.ClientID = config.Google.Auth.Client
 	data.Slug = name
 	data.Prefix = config.Prefix
@@ -112,29 +425,74 @@ func renderTemplate(c context.Context, name string, partial bool, data *template
 	if data.OgImage == "" {
 		data.OgImage = ogImageDefault
 	}
+
+	exec, err := localizeTemplate(tpl, data.Lang)
+	if err != nil {
+		return nil, "", err
+	}
 	if data.Title == "" {
-		data.Title = pageTitle(tpl)
+		data.Title = pageTitle(exec)
 	}
 	if data.OgTitle == "" {
 		data.OgTitle = data.Title
 	}
 
 	var b bytes.Buffer
-	if err := tpl.Execute(&b, data); err != nil {
-		return nil, err
+	if err := exec.Execute(&b, data); err != nil {
+		return nil, "", err
 	}
-	return b.Bytes(), nil
+	return b.Bytes(), data.ContentType, nil
 }
 
-// parseTemplate creates a template identified by name, using appropriate layout.
+// localizeTemplate clones tpl and rebinds its url and T funcs to lang, so
+// concurrent renders of the same cached template in different locales
+// never race over the shared func map. It always clones, even for the
+// default "en" locale: html/template.Template.Clone refuses to clone a
+// template that has already been executed, so executing the cached
+// master directly - even once, for an "en" render - would permanently
+// break every later render of that template in any locale.
+func localizeTemplate(tpl anyTemplate, lang string) (anyTemplate, error) {
+	if lang == "" {
+		lang = "en"
+	}
+	funcs := map[string]interface{}{
+		"url": func(parts ...string) string { return resourceURLLang(lang, parts...) },
+		"T":   func(key string, args ...interface{}) string { return i18n.T(lang, key, args...) },
+	}
+	switch t := tpl.(type) {
+	case *template.Template:
+		clone, err := t.Clone()
+		if err != nil {
+			return nil, err
+		}
+		return clone.Funcs(funcs), nil
+	case *texttemplate.Template:
+		clone, err := t.Clone()
+		if err != nil {
+			return nil, err
+		}
+		return clone.Funcs(funcs), nil
+	default:
+		return tpl, nil
+	}
+}
+
+// parseTemplate creates a template identified by name, using appropriate layout,
+// and returns it along with the Content-Type it should be served with.
 // HTTP error layout is used for name arg prefixed with "error_", e.g. "error_404".
-func parseTemplate(name string, partial bool) (*template.Template, error) {
+// Names whose suffix matches an entry in outputFormats (e.g. "feed.json") are
+// parsed with text/template against layout_text.txt, so they aren't HTML-escaped.
+func parseTemplate(name string, partial bool) (anyTemplate, string, error) {
+	format := formatForName(name)
+
 	var layout string
 	switch {
 	case strings.HasPrefix(name, "error_"):
 		layout = "layout_error.html"
 	case name == "upgrade":
 		layout = "layout_bare.html"
+	case format.text:
+		layout = "layout_text.txt"
 	case partial:
 		layout = "layout_partial.html"
 	default:
@@ -142,27 +500,82 @@ func parseTemplate(name string, partial bool) (*template.Template, error) {
 	}
 
 	key := name + layout
-	tmplCache.Lock()
-	defer tmplCache.Unlock()
-	if t, ok := tmplCache.templates[key]; ok {
-		return t, nil
+	if t, ok := tmplCache.Load(key); ok {
+		return t.(anyTemplate), format.contentType, nil
 	}
 
-	t, err := template.New(layout).Delims("{%", "%}").Funcs(tmplFunc).ParseFiles(
-		filepath.Join(config.Dir, templatesDir, layout),
-		filepath.Join(config.Dir, templatesDir, name+".html"),
-	)
+	src, err := templateSource()
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	var t anyTemplate
+	if format.text {
+		t, err = texttemplate.New(layout).Delims("{%", "%}").Funcs(textTmplFunc).ParseFS(src, layout, name+".html")
+	} else {
+		t, err = template.New(layout).Delims("{%", "%}").Funcs(tmplFunc).ParseFS(src, layout, name+".html")
+	}
+	if err != nil {
+		return nil, "", err
 	}
 	if !isDev() {
-		tmplCache.templates[key] = t
+		tmplCache.Store(key, t)
+	}
+	return t, format.contentType, nil
+}
+
+// warmPartials returns the partial values WarmTemplates should parse name
+// under: layout_error.html, layout_bare.html and layout_text.txt are each
+// chosen regardless of the partial flag, so only the default full-page
+// render is worth precompiling; everything else can be requested either
+// as a full page or as a layout_partial.html fragment.
+func warmPartials(name string) []bool {
+	if strings.HasPrefix(name, "error_") || name == "upgrade" || formatForName(name).text {
+		return []bool{false}
+	}
+	return []bool{false, true}
+}
+
+// WarmTemplates parses every (name, layout, partial) combination the
+// router can produce against templatesDir and populates tmplCache with
+// the results, so a malformed template fails the deploy at startup
+// instead of the first request that happens to hit it. It's called once
+// from main before the server starts accepting requests. In dev mode
+// parseTemplate never caches its results (see the isDev check above), so
+// this still validates every template but editing one on disk continues
+// to pick up changes without a restart.
+func WarmTemplates(c context.Context) error {
+	src, err := templateSource()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	err = fs.WalkDir(src, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(p)
+		if d.IsDir() || ext != ".html" || strings.HasPrefix(p, "layout_") {
+			return nil
+		}
+		name := p[:len(p)-len(ext)]
+		for _, partial := range warmPartials(name) {
+			if _, _, err := parseTemplate(name, partial); err != nil {
+				errs = append(errs, fmt.Sprintf("%s (partial=%v): %v", name, partial, err))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("WarmTemplates: %d template(s) failed to parse:\n%s", len(errs), strings.Join(errs, "\n"))
 	}
-	return t, nil
+	return nil
 }
 
 // pageTitle executes "title" template and returns its result or defaultTitle.
-func pageTitle(t *template.Template) string {
+func pageTitle(t anyTemplate) string {
 	b := new(bytes.Buffer)
 	if err := t.ExecuteTemplate(b, "title", nil); err != nil || b.Len() == 0 {
 		return defaultTitle
@@ -170,15 +583,36 @@ func pageTitle(t *template.Template) string {
 	return b.String()
 }
 
+// localizedRoutes are resourceURL targets known to have a translated
+// variant, i.e. pages rendered with i18n content by renderTemplate.
+// Everything else - static assets, and any page this list hasn't caught
+// up with - is served in the default locale only, so resourceURLLang
+// never links a non-English render to a page that 404s.
+var localizedRoutes = map[string]bool{
+	"":         true, // home
+	"schedule": true,
+}
+
 // resourceURL returns absolute path to a resource referenced by parts.
 // For instance, given config.Prefix = "/myprefix", resourceURL("images", "img.jpg")
 // returns "/myprefix/images/img.jpg".
 // If the first part starts with http(s)://, it is the returned value.
 func resourceURL(parts ...string) string {
+	return resourceURLLang("", parts...)
+}
+
+// resourceURLLang is like resourceURL, but when lang is a non-default
+// locale and parts[0] is a localized route (see localizedRoutes), it
+// prepends the locale segment, e.g. resourceURLLang("es", "schedule")
+// returns "/myprefix/es/schedule".
+func resourceURLLang(lang string, parts ...string) string {
 	lp := strings.ToLower(parts[0])
 	if strings.HasPrefix(lp, "http://") || strings.HasPrefix(lp, "https://") {
 		return parts[0]
 	}
+	if lang != "" && lang != "en" && localizedRoutes[parts[0]] {
+		parts = append([]string{lang}, parts...)
+	}
 	p := strings.Join(parts, "/")
 	if !strings.HasPrefix(p, config.Prefix) {
 		p = config.Prefix + "/" + p
@@ -186,59 +620,287 @@ func resourceURL(parts ...string) string {
 	return path.Clean(p)
 }
 
-// getSitemap returns a sitemap containing both templated pages
-// and schedule session details.
-func getSitemap(c context.Context, baseURL *url.URL) (*sitemap, error) {
-	items := make([]*sitemapItem, 0)
+// withLocale returns relPath with loc inserted as its leading segment,
+// e.g. withLocale("schedule", "es") returns "es/schedule". The default
+// locale, "en", is left unprefixed.
+func withLocale(relPath, loc string) string {
+	switch {
+	case loc == "" || loc == "en":
+		return relPath
+	case relPath == "":
+		return loc
+	default:
+		return loc + "/" + relPath
+	}
+}
 
-	// templated pages
-	root := filepath.Join(config.Dir, templatesDir)
-	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+// sitemapAlternatesFor returns one xhtml:link per configured locale (plus
+// the implicit "en" default), pointing at rel's localized variant
+// resolved against baseURL. Used as sitemapItem.Alternates so Google can
+// associate a page's localized variants with its canonical entry. route
+// is checked against localizedRoutes; pages with no localized variant
+// get no alternates rather than links that 404.
+func sitemapAlternatesFor(baseURL *url.URL, route string, rel *url.URL) []sitemapAlternate {
+	if !localizedRoutes[route] {
+		return nil
+	}
+	locales := append([]string{"en"}, i18n.Locales()...)
+	alts := make([]sitemapAlternate, 0, len(locales))
+	for _, loc := range locales {
+		lr := *rel
+		lr.Path = withLocale(lr.Path, loc)
+		alts = append(alts, sitemapAlternate{
+			Rel:      "alternate",
+			Hreflang: loc,
+			Href:     baseURL.ResolveReference(&lr).String(),
+		})
+	}
+	return alts
+}
+
+// sitemapItems streams every sitemap entry - templated pages followed by
+// schedule sessions - onto the returned channel, closing it once done.
+// Any error is sent on the returned error channel before items closes;
+// callers should drain items first, then check errc. Items stop being
+// produced as soon as c is canceled.
+func sitemapItems(c context.Context, baseURL *url.URL) (<-chan *sitemapItem, <-chan error) {
+	items := make(chan *sitemapItem)
+	errc := make(chan error, 1)
+
+	send := func(item *sitemapItem) error {
+		select {
+		case items <- item:
+			return nil
+		case <-c.Done():
+			return c.Err()
+		}
+	}
+
+	go func() {
+		defer close(items)
+		defer close(errc)
+
+		src, err := templateSource()
+		if err != nil {
+			errc <- err
+			return
+		}
+		err = fs.WalkDir(src, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			ext := filepath.Ext(p)
+			if p == "." || d.IsDir() || ext != ".html" {
+				return nil
+			}
+			name := p[:len(p)-len(ext)]
+			for _, s := range skipSitemap {
+				if strings.HasPrefix(name, s) {
+					return nil
+				}
+			}
+			freq := "weekly"
+			if name == "home" {
+				name = ""
+				freq = "daily"
+			}
+			rel := &url.URL{Path: name}
+			return send(&sitemapItem{
+				Loc:        baseURL.ResolveReference(rel).String(),
+				Freq:       freq,
+				Alternates: sitemapAlternatesFor(baseURL, name, rel),
+			})
+		})
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		sched, err := getLatestEventData(c, nil)
+		if err != nil {
+			errc <- err
+			return
+		}
+		mod := sched.modified.In(time.UTC)
+		// Sessions is a map, so its iteration order is randomized on
+		// every call; sort the IDs first so the ordinal partition
+		// writeURLSet uses to carve out a shard is stable across the
+		// separate requests that fetch the index and each shard.
+		ids := make([]string, 0, len(sched.Sessions))
+		for id := range sched.Sessions {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			// Built directly, like the templated-pages rel above, rather
+			// than through reverse: reverse bakes in config.Prefix for
+			// browser-facing hrefs, but baseURL here already carries
+			// whatever path the sitemap is served under, so adding the
+			// prefix again would double it up whenever baseURL's path
+			// isn't exactly config.Prefix. Loc and its alternates share
+			// this same rel, so the "en" alternate is always identical
+			// to the canonical Loc.
+			rel := &url.URL{Path: "schedule", RawQuery: url.Values{"sid": {id}}.Encode()}
+			if err := send(&sitemapItem{
+				Loc:        baseURL.ResolveReference(rel).String(),
+				Mod:        &mod,
+				Freq:       "daily",
+				Alternates: sitemapAlternatesFor(baseURL, "schedule", rel),
+			}); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	return items, errc
+}
+
+// sitemapItemCount returns the total number of entries sitemapItems would
+// produce, without buffering them, so WriteSitemapIndex can work out how
+// many shards are needed.
+func sitemapItemCount(c context.Context) (int, error) {
+	src, err := templateSource()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = fs.WalkDir(src, ".", func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		ext := filepath.Ext(p)
-		if p == root || fi.IsDir() || ext != ".html" {
+		if p == "." || d.IsDir() || ext != ".html" {
 			return nil
 		}
-		name := p[len(root)+1 : len(p)-len(ext)]
+		name := p[:len(p)-len(ext)]
 		for _, s := range skipSitemap {
 			if strings.HasPrefix(name, s) {
 				return nil
 			}
 		}
-		freq := "weekly"
-		if name == "home" {
-			name = ""
-			freq = "daily"
-		}
-		item := &sitemapItem{
-			Loc:  baseURL.ResolveReference(&url.URL{Path: name}).String(),
-			Freq: freq,
-		}
-		items = append(items, item)
+		n++
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-
-	// schedule
 	sched, err := getLatestEventData(c, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	return n + len(sched.Sessions), nil
+}
+
+// writeURLSet streams items into an xml urlset document written to w. lo
+// and hi (indices into the overall, unsharded item sequence) restrict
+// which items are actually encoded; pass (0, -1) to encode all of them.
+// Once i reaches hi, or encoding an item fails, writeURLSet calls cancel
+// and stops reading from items instead of draining it to completion:
+// cancel must be wired to the context sitemapItems(c, ...) was given, so
+// its producer goroutine observes c.Done() on its next blocked send and
+// exits instead of leaking. A resulting context.Canceled on errc is
+// therefore expected, not a real failure, and is swallowed.
+func writeURLSet(w io.Writer, items <-chan *sitemapItem, errc <-chan error, cancel context.CancelFunc, lo, hi int) error {
+	enc := xml.NewEncoder(w)
+	start := xml.StartElement{
+		Name: xml.Name{Local: "urlset"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "xmlns"}, Value: "http://www.sitemaps.org/schemas/sitemap/0.9"},
+			{Name: xml.Name{Local: "xmlns:xhtml"}, Value: "http://www.w3.org/1999/xhtml"},
+		},
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		cancel()
+		return err
 	}
-	mod := sched.modified.In(time.UTC)
-	for id, _ := range sched.Sessions {
-		u := baseURL.ResolveReference(&url.URL{Path: "schedule"})
-		u.RawQuery = url.Values{"sid": {id}}.Encode()
-		item := &sitemapItem{
-			Loc:  u.String(),
-			Mod:  &mod,
-			Freq: "daily",
+	i := 0
+	for item := range items {
+		if hi >= 0 && i >= hi {
+			cancel()
+			break
+		}
+		if i >= lo {
+			if err := enc.Encode(item); err != nil {
+				cancel()
+				return err
+			}
 		}
-		items = append(items, item)
+		i++
+	}
+	if err := <-errc; err != nil && err != context.Canceled {
+		return err
+	}
+	if err := enc.EncodeToken(start.End()); err != nil {
+		return err
 	}
+	return enc.Flush()
+}
+
+// WriteSitemap writes a single <urlset> document containing every
+// templated page and schedule session, streaming entries as they're
+// produced so memory use stays bounded regardless of session count.
+// Use WriteSitemapIndex and WriteSitemapShard instead once the total
+// exceeds sitemapShardSize.
+func WriteSitemap(c context.Context, w io.Writer, baseURL *url.URL) error {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	items, errc := sitemapItems(ctx, baseURL)
+	return writeURLSet(w, items, errc, cancel, 0, -1)
+}
 
-	return &sitemap{Items: items}, nil
+// WriteSitemapIndex writes a sitemap index document listing one shard per
+// sitemapShardSize entries, named "sitemap-1.xml.gz", "sitemap-2.xml.gz"
+// and so on relative to baseURL; WriteSitemapShard produces each shard's
+// actual content. Callers should set the Content-Type response header to
+// sitemapContentType.
+func WriteSitemapIndex(c context.Context, w io.Writer, baseURL *url.URL) error {
+	total, err := sitemapItemCount(c)
+	if err != nil {
+		return err
+	}
+	shards := (total + sitemapShardSize - 1) / sitemapShardSize
+	if shards == 0 {
+		shards = 1
+	}
+
+	enc := xml.NewEncoder(w)
+	start := xml.StartElement{
+		Name: xml.Name{Local: "sitemapindex"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: "http://www.sitemaps.org/schemas/sitemap/0.9"}},
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for i := 1; i <= shards; i++ {
+		loc := baseURL.ResolveReference(&url.URL{Path: fmt.Sprintf("sitemap-%d.xml.gz", i)})
+		if err := enc.Encode(&sitemapIndexItem{Loc: loc.String()}); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// WriteSitemapShard gzips and writes the shard-th (1-indexed) page of
+// sitemap entries, capped at sitemapShardSize URLs per WriteSitemapIndex.
+// It stops producing entries as soon as this shard's slice is written,
+// rather than running the producer out to the end of the catalog, so a
+// request for an early shard doesn't pay for every session behind it.
+// Callers should set the Content-Type response header to
+// sitemapGzipContentType.
+func WriteSitemapShard(c context.Context, w io.Writer, baseURL *url.URL, shard int) error {
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	items, errc := sitemapItems(ctx, baseURL)
+	lo := (shard - 1) * sitemapShardSize
+	if err := writeURLSet(gz, items, errc, cancel, lo, lo+sitemapShardSize); err != nil {
+		return err
+	}
+	return gz.Close()
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestReverse(t *testing.T) {
+	config.Prefix = "/io2015"
+
+	got, err := reverse("schedule.session", "sid", "abc")
+	if err != nil {
+		t.Fatalf("reverse: %v", err)
+	}
+	if want := "/io2015/schedule?sid=abc"; string(got) != want {
+		t.Errorf("reverse(\"schedule.session\", \"sid\", \"abc\") = %q, want %q", got, want)
+	}
+
+	if _, err := reverse("no.such.route"); err == nil {
+		t.Error("reverse: unregistered route: want error, got nil")
+	}
+
+	if _, err := reverse("schedule.session", "sid"); err == nil {
+		t.Error("reverse: odd number of args: want error, got nil")
+	}
+}
+
+func TestFormatForName(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		text        bool
+	}{
+		{"feed.json", "application/json; charset=utf-8", true},
+		{"schedule.ics", "text/calendar; charset=utf-8", true},
+		{"sitemap.xml", "application/xml; charset=utf-8", true},
+		{"robots.txt", "text/plain; charset=utf-8", true},
+		{"home", defaultContentType, false},
+		{"about.html", defaultContentType, false},
+	}
+	for _, tt := range tests {
+		got := formatForName(tt.name)
+		if got.contentType != tt.contentType || got.text != tt.text {
+			t.Errorf("formatForName(%q) = {%q %v}, want {%q %v}", tt.name, got.contentType, got.text, tt.contentType, tt.text)
+		}
+	}
+}
+
+func TestLocaleForRequest(t *testing.T) {
+	fixture := fstest.MapFS{
+		"i18n/es.yaml": &fstest.MapFile{Data: []byte("greeting: hola\n")},
+	}
+	provider, err := LoadTranslations(fixture)
+	if err != nil {
+		t.Fatalf("LoadTranslations: %v", err)
+	}
+	origI18n, origPrefix := i18n, config.Prefix
+	i18n, config.Prefix = provider, "/io2015"
+	defer func() { i18n, config.Prefix = origI18n, origPrefix }()
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		want   string
+	}{
+		{name: "locale URL prefix wins", path: "/io2015/es/schedule", want: "es"},
+		{name: "unconfigured prefix falls back to header", path: "/io2015/fr/schedule", accept: "es-MX,en;q=0.8", want: "es"},
+		{name: "accept-language region tag", path: "/io2015/schedule", accept: "es-MX", want: "es"},
+		{name: "default en", path: "/io2015/schedule", want: "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Language", tt.accept)
+			}
+			if got := localeForRequest(r); got != tt.want {
+				t.Errorf("localeForRequest(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarmPartials(t *testing.T) {
+	tests := []struct {
+		name string
+		want []bool
+	}{
+		{"error_404", []bool{false}},
+		{"upgrade", []bool{false}},
+		{"feed.json", []bool{false}},
+		{"schedule", []bool{false, true}},
+		{"home", []bool{false, true}},
+	}
+	for _, tt := range tests {
+		got := warmPartials(tt.name)
+		if len(got) != len(tt.want) {
+			t.Fatalf("warmPartials(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("warmPartials(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+// TestWriteURLSetSharding exercises the shard math writeURLSet and
+// WriteSitemapShard rely on: fetching consecutive (lo, hi) windows over
+// the same producer sequence must cover every item exactly once, in
+// order, and a window that ends before the producer is done must not
+// leave the producer goroutine blocked on its next send.
+func TestWriteURLSetSharding(t *testing.T) {
+	const total = 7
+
+	newProducer := func(ctx context.Context) (<-chan *sitemapItem, <-chan error, <-chan struct{}) {
+		items := make(chan *sitemapItem)
+		errc := make(chan error, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(items)
+			defer close(errc)
+			defer close(done)
+			for i := 0; i < total; i++ {
+				item := &sitemapItem{Loc: fmt.Sprintf("/page-%d", i)}
+				select {
+				case items <- item:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+		}()
+		return items, errc, done
+	}
+
+	shards := [][2]int{{0, 3}, {3, 6}, {6, 9}}
+	var all []string
+	for _, s := range shards {
+		lo, hi := s[0], s[1]
+		ctx, cancel := context.WithCancel(context.Background())
+		items, errc, done := newProducer(ctx)
+
+		var buf bytes.Buffer
+		if err := writeURLSet(&buf, items, errc, cancel, lo, hi); err != nil {
+			t.Fatalf("writeURLSet(lo=%d, hi=%d): %v", lo, hi, err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("writeURLSet(lo=%d, hi=%d) returned but its producer goroutine leaked", lo, hi)
+		}
+
+		var parsed struct {
+			URLs []struct {
+				Loc string `xml:"loc"`
+			} `xml:"url"`
+		}
+		if err := xml.Unmarshal(buf.Bytes(), &parsed); err != nil {
+			t.Fatalf("unmarshal shard(lo=%d, hi=%d) output: %v", lo, hi, err)
+		}
+		for _, u := range parsed.URLs {
+			all = append(all, u.Loc)
+		}
+	}
+
+	if len(all) != total {
+		t.Fatalf("shards together produced %d urls, want %d: %v", len(all), total, all)
+	}
+	for i, loc := range all {
+		if want := fmt.Sprintf("/page-%d", i); loc != want {
+			t.Errorf("combined shard entry %d = %q, want %q", i, loc, want)
+		}
+	}
+}